@@ -0,0 +1,92 @@
+package rpc
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"sync/atomic"
+)
+
+const debugText = `<html>
+	<body>
+	<title>Services</title>
+	{{range .}}
+	<hr>
+	Service {{.Name}}
+	<hr>
+		<table>
+		<th align=center>Method</th><th align=center>Calls</th><th align=center>Errors</th><th align=center>p50</th><th align=center>p99</th>
+		{{range .Method}}
+			<tr>
+			<td align=left font=fixed>{{.Name}}({{.ArgType}}, {{.ReplyType}}) error</td>
+			<td align=center>{{.Calls}}</td>
+			<td align=center>{{.Errors}}</td>
+			<td align=center>{{.P50}}</td>
+			<td align=center>{{.P99}}</td>
+			</tr>
+		{{end}}
+		</table>
+	{{end}}
+	</body>
+	</html>`
+
+var debugTemplate = template.Must(template.New("RPC debug").Parse(debugText))
+
+// debugMethod is the row rendered for one registered method.
+type debugMethod struct {
+	Name      string
+	ArgType   string
+	ReplyType string
+	Calls     int64
+	Errors    int64
+	P50       string
+	P99       string
+}
+
+// debugService is the set of rows rendered for one registered service.
+type debugService struct {
+	Name   string
+	Method []debugMethod
+}
+
+// debugHTTP implements http.Handler for the /debug/rpc page, walking the
+// wrapped Server's serviceMap and stats to render live call counters and
+// latency percentiles alongside each registered method.
+type debugHTTP struct {
+	*Server
+}
+
+// Runs at /debug/rpc.
+func (server debugHTTP) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	// Build a sorted version of the data.
+	var services []debugService
+	for sname, svc := range server.serviceMap {
+		ds := debugService{Name: sname}
+		for mname, mtype := range svc.method {
+			dm := debugMethod{
+				Name:      mname,
+				ArgType:   mtype.ArgType.String(),
+				ReplyType: mtype.ReplyType.String(),
+			}
+			if v, ok := server.stats.Load(sname + "." + mname); ok {
+				ms := v.(*methodStat)
+				dm.Calls = atomic.LoadInt64(&ms.calls)
+				dm.Errors = atomic.LoadInt64(&ms.errors)
+				p50, p99 := ms.percentiles()
+				dm.P50 = p50.String()
+				dm.P99 = p99.String()
+			}
+			ds.Method = append(ds.Method, dm)
+		}
+		sort.Slice(ds.Method, func(i, j int) bool { return ds.Method[i].Name < ds.Method[j].Name })
+		services = append(services, ds)
+	}
+	sort.Slice(services, func(i, j int) bool { return services[i].Name < services[j].Name })
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := debugTemplate.Execute(w, services)
+	if err != nil {
+		fmt.Fprintln(w, "rpc: error executing template:", err.Error())
+	}
+}
@@ -0,0 +1,141 @@
+// Package jsonrpc implements a rpc.ServerCodec for JSON-RPC 2.0, framed as
+// one JSON object per line, so that non-Go clients (browsers, mobile apps,
+// curl/nc scripts) can call services registered on a rpc.Server without
+// speaking gob.
+//
+// The JSON-RPC 2.0 request object has no wire representation for rpc's
+// Stream, Cancel or Deadline frames, so this codec only ever produces
+// plain unary requests: every "id" maps to exactly one response. Clients
+// that need streaming methods or in-flight cancellation should use the
+// gob or msgpackrpc codecs instead.
+package jsonrpc
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"go-common/net/rpc"
+)
+
+// serverRequest is the wire shape of a JSON-RPC 2.0 request object.
+type serverRequest struct {
+	Version string           `json:"jsonrpc"`
+	Method  string           `json:"method"`
+	Params  *json.RawMessage `json:"params"`
+	ID      *json.RawMessage `json:"id"`
+}
+
+// serverResponse is the wire shape of a JSON-RPC 2.0 response object.
+type serverResponse struct {
+	Version string           `json:"jsonrpc"`
+	ID      *json.RawMessage `json:"id"`
+	Result  interface{}      `json:"result,omitempty"`
+	Error   *serverError     `json:"error,omitempty"`
+}
+
+// serverError is the wire shape of a JSON-RPC 2.0 error object. BFS doesn't
+// classify rpc errors into codes, so every error is reported as -32000
+// ("server error") with the original message attached.
+type serverError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+const serverErrorCode = -32000
+
+// serverCodec implements rpc.ServerCodec on top of a newline-framed JSON-RPC
+// 2.0 stream: one encoded request or response object per line.
+type serverCodec struct {
+	dec *json.Decoder
+	enc *json.Encoder
+	c   net.Conn
+
+	req serverRequest
+
+	mutex   sync.Mutex // protects seq and pending
+	seq     uint64
+	pending map[uint64]*json.RawMessage
+
+	closed bool
+}
+
+// NewServerCodec returns a new rpc.ServerCodec speaking JSON-RPC 2.0 over
+// conn, suitable for rpc.Server.ServeCodec.
+func NewServerCodec(conn net.Conn) rpc.ServerCodec {
+	return &serverCodec{
+		dec:     json.NewDecoder(conn),
+		enc:     json.NewEncoder(conn),
+		c:       conn,
+		pending: make(map[uint64]*json.RawMessage),
+	}
+}
+
+func (c *serverCodec) ReadRequestHeader(r *rpc.Request) error {
+	c.req = serverRequest{}
+	if err := c.dec.Decode(&c.req); err != nil {
+		return err
+	}
+	if c.req.Version != "2.0" {
+		return errors.New("jsonrpc: invalid jsonrpc version " + c.req.Version)
+	}
+
+	// JSON-RPC 2.0 allows an "id" of any JSON scalar (string, number, or
+	// null), but rpc.Request.Seq is a uint64 this codec never exposes on
+	// the wire (it's unary-only, so nothing demuxes by Seq). Assign our
+	// own monotonic Seq and keep the client's original id in pending so
+	// WriteResponse can echo it back unchanged, whatever shape it was.
+	c.mutex.Lock()
+	c.seq++
+	seq := c.seq
+	c.pending[seq] = c.req.ID
+	c.mutex.Unlock()
+
+	r.ServiceMethod = c.req.Method
+	r.Seq = seq
+	return nil
+}
+
+func (c *serverCodec) ReadRequestBody(body interface{}) error {
+	if body == nil || c.req.Params == nil {
+		return nil
+	}
+	return json.Unmarshal(*c.req.Params, body)
+}
+
+func (c *serverCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	c.mutex.Lock()
+	id, ok := c.pending[r.Seq]
+	if ok {
+		delete(c.pending, r.Seq)
+	}
+	c.mutex.Unlock()
+	if !ok {
+		return errors.New("jsonrpc: invalid sequence number in response")
+	}
+
+	resp := serverResponse{Version: "2.0", ID: id}
+	if r.Error != "" {
+		resp.Error = &serverError{Code: serverErrorCode, Message: r.Error}
+	} else {
+		resp.Result = body
+	}
+	return c.enc.Encode(resp)
+}
+
+func (c *serverCodec) Close() error {
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	return c.c.Close()
+}
+
+// RemoteAddr implements rpc.RemoteAddrCodec.
+func (c *serverCodec) RemoteAddr() net.Addr { return c.c.RemoteAddr() }
+
+// SetReadDeadline implements rpc's deadlineCodec, used by its keepalive
+// reaper.
+func (c *serverCodec) SetReadDeadline(t time.Time) error { return c.c.SetReadDeadline(t) }
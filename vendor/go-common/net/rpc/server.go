@@ -8,9 +8,13 @@ import (
 	"io"
 	"log"
 	"net"
+	"net/http"
 	"reflect"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 	"unicode"
 	"unicode/utf8"
 
@@ -21,7 +25,19 @@ import (
 const (
 	_authServiceMethod = "inner.Auth"
 	_pingServiceMethod = "inner.Ping"
+	_eosServiceMethod  = "inner.EOS"
 	_service           = "inner"
+
+	// lastStreamResponseError is the sentinel Response.Error value that
+	// marks a clean end of a stream, as opposed to a handler failure.
+	lastStreamResponseError = "EOS"
+
+	// _connected is written back to a hijacked HTTP CONNECT before it's
+	// handed off to ServeConn, matching stdlib net/rpc's handshake.
+	_connected = "200 Connected to Go RPC"
+
+	_defaultRPCPath   = "/_goRPC_"
+	_defaultDebugPath = "/debug/rpc"
 )
 
 var (
@@ -29,6 +45,7 @@ var (
 	// because Typeof takes an empty interface value. This is annoying.
 	typeOfError = reflect.TypeOf((*error)(nil)).Elem()
 	ctxType     = reflect.TypeOf((*context.Context)(nil)).Elem()
+	streamType  = reflect.TypeOf((*Stream)(nil)).Elem()
 	class       = trace.ClassService
 
 	_pingArg = &struct{}{}
@@ -38,6 +55,7 @@ type methodType struct {
 	method    reflect.Method
 	ArgType   reflect.Type
 	ReplyType reflect.Type
+	Stream    bool // true if ReplyType is an rpc.Stream rather than a reply pointer
 }
 
 type service struct {
@@ -54,6 +72,9 @@ type Request struct {
 	ServiceMethod string        // format: "Service.Method"
 	Seq           uint64        // sequence number chosen by client
 	Trace         *trace.Trace2 // trace info
+	Stream        bool          // true for every frame of a streaming call, including the first
+	Deadline      int64         // optional, unix nanos; 0 means no client-supplied deadline
+	Cancel        bool          // true to cancel the in-flight call with the same Seq instead of starting one
 
 	ctx context.Context
 }
@@ -70,7 +91,8 @@ type Auth struct {
 type Response struct {
 	ServiceMethod string // echoes that of the Request
 	Seq           uint64 // echoes that of the request
-	Error         string // error, if any.
+	Error         string // error, if any. lastStreamResponseError marks a clean stream end.
+	Stream        bool   // true for every frame of a streaming call, including the last
 }
 
 // Interceptor interface.
@@ -78,6 +100,60 @@ type Interceptor interface {
 	Rate(context.Context) error
 	Stat(context.Context, interface{}, error)
 	Auth(context.Context, net.Addr, string) error // ip, token
+	// OnDisconnect is called once per connection served by ServeConn/
+	// ServeCodec, after the codec has been closed. reason is the error
+	// that ended the connection: io.EOF/io.ErrUnexpectedEOF for a normal
+	// client hangup, or the keepalive timeout error if the reaper closed
+	// an idle connection. addr is nil if the codec doesn't implement
+	// RemoteAddrCodec.
+	OnDisconnect(ctx context.Context, addr net.Addr, reason error)
+}
+
+// Stream is passed in place of the reply pointer to a streaming service
+// method, e.g. func (t *T) Name(ctx context.Context, arg A, stream rpc.Stream) error.
+// It lets a handler exchange any number of frames with the client instead
+// of returning a single reply, for chunked uploads/downloads and
+// long-lived server push.
+type Stream interface {
+	// Send writes v as the next frame on the stream.
+	Send(v interface{}) error
+	// Recv blocks for the next frame sent by the client and decodes it
+	// into v. It returns io.EOF once the client closes its side.
+	Recv(v interface{}) error
+	// Context returns the context of the call that opened the stream.
+	Context() context.Context
+}
+
+// ServerCodec implements reading of RPC requests and writing of RPC
+// responses for the server side of an RPC session. The server calls
+// ReadRequestHeader and ReadRequestBody in pairs to read requests from the
+// connection, and calls WriteResponse to write a response back. The
+// server calls Close when finished with the connection.
+//
+// Implementations are free to choose their own wire format; the stock
+// gob codec used by ServeConn and the jsonrpc/msgpackrpc subpackages
+// are all built against this interface, so any of them can be handed
+// to ServeCodec interchangeably.
+type ServerCodec interface {
+	ReadRequestHeader(*Request) error
+	ReadRequestBody(interface{}) error
+	WriteResponse(*Response, interface{}) error
+	Close() error
+}
+
+// RemoteAddrCodec is an optional interface a ServerCodec may implement to
+// expose the address of the underlying connection. When present, it is
+// used to feed Interceptor.Auth during the handshake.
+type RemoteAddrCodec interface {
+	RemoteAddr() net.Addr
+}
+
+// deadlineCodec is an optional interface a ServerCodec may implement to let
+// the keepalive reaper bound how long it'll wait for the next frame. All
+// three codecs shipped alongside this package (gob, jsonrpc, msgpackrpc)
+// implement it since they're all backed by a net.Conn.
+type deadlineCodec interface {
+	SetReadDeadline(t time.Time) error
 }
 
 // Server represents an RPC Server.
@@ -85,6 +161,163 @@ type Server struct {
 	serviceMap  map[string]*service
 	Interceptor Interceptor
 	Handshake   bool
+
+	streams  sync.Map // streamKey -> *serverStream, open streaming calls across all connections
+	codecs   sync.Map // ServerCodec -> struct{}, connections currently being served
+	inflight sync.Map // callKey -> context.CancelFunc, calls a client can still cancel by Seq
+
+	methodTimeouts sync.Map // ServiceMethod -> time.Duration, set via SetMethodTimeout
+	stats          sync.Map // ServiceMethod -> *methodStat, consulted by the /debug/rpc page
+
+	keepaliveIdle      int64 // time.Duration, atomic; 0 disables the reaper
+	keepaliveInterval  int64 // time.Duration, atomic; advisory, for client-side ping pacing
+	keepaliveMaxMissed int32 // atomic; idle windows tolerated before closing
+
+	mu       sync.Mutex
+	closing  bool
+	listener net.Listener
+	wg       sync.WaitGroup // in-flight service.call/callStream goroutines
+}
+
+// callKey identifies an in-flight call within a Server the same way
+// streamKey identifies an open stream: Seq is only unique per connection,
+// so the codec it arrived on disambiguates calls from different
+// connections that happen to pick the same Seq.
+type callKey struct {
+	codec ServerCodec
+	seq   uint64
+}
+
+// SetMethodTimeout bounds how long service.call/callStream wait for
+// serviceMethod's handler to return before giving up and reporting
+// context.DeadlineExceeded. It applies to every call of serviceMethod; a
+// client-supplied Request.Deadline that falls earlier still takes effect.
+func (server *Server) SetMethodTimeout(serviceMethod string, d time.Duration) {
+	server.methodTimeouts.Store(serviceMethod, d)
+}
+
+func (server *Server) methodTimeout(serviceMethod string) (time.Duration, bool) {
+	v, ok := server.methodTimeouts.Load(serviceMethod)
+	if !ok {
+		return 0, false
+	}
+	return v.(time.Duration), true
+}
+
+// SetKeepalive enables the idle-connection reaper: every ServeConn/
+// ServeCodec connection is closed if idle*maxMissed elapses without a
+// frame arriving, which in practice means the client must issue
+// inner.Ping at roughly every interval or risk being evicted. Passing
+// idle <= 0 disables the reaper.
+func (server *Server) SetKeepalive(idle, interval time.Duration, maxMissed int) {
+	atomic.StoreInt64(&server.keepaliveIdle, int64(idle))
+	atomic.StoreInt64(&server.keepaliveInterval, int64(interval))
+	atomic.StoreInt32(&server.keepaliveMaxMissed, int32(maxMissed))
+}
+
+// keepaliveWindow returns how long ServeCodec should let a connection sit
+// without a frame before the reaper closes it, or ok=false if disabled.
+func (server *Server) keepaliveWindow() (d time.Duration, ok bool) {
+	idle := time.Duration(atomic.LoadInt64(&server.keepaliveIdle))
+	if idle <= 0 {
+		return 0, false
+	}
+	missed := atomic.LoadInt32(&server.keepaliveMaxMissed)
+	if missed < 1 {
+		missed = 1
+	}
+	return idle * time.Duration(missed), true
+}
+
+// cancelConn invokes the cancel func of every call still tracked in
+// server.inflight for codec, used when the keepalive reaper or Shutdown
+// closes a connection out from under its in-flight handlers.
+func (server *Server) cancelConn(codec ServerCodec) {
+	server.inflight.Range(func(k, v interface{}) bool {
+		if k.(callKey).codec == codec {
+			v.(ctx.CancelFunc)()
+		}
+		return true
+	})
+}
+
+// abandonInflight cancels and forgets the inflight entry lookupRequest
+// stored for (codec, seq), used by ServeCodec when a request's body fails
+// to decode after a successful service/method lookup: no service.call or
+// callStream goroutine will ever run to do this via its own defer, so
+// without this the callKey and its cancel func/timer would leak for the
+// life of the connection.
+func (server *Server) abandonInflight(codec ServerCodec, seq uint64) {
+	key := callKey{codec, seq}
+	if v, ok := server.inflight.Load(key); ok {
+		v.(ctx.CancelFunc)()
+	}
+	server.inflight.Delete(key)
+}
+
+// methodStat accumulates the counters the /debug/rpc page renders for one
+// ServiceMethod: total calls, errors, and a small ring buffer of recent
+// latencies good enough for an approximate p50/p99 without keeping every
+// sample a busy server has ever seen.
+type methodStat struct {
+	calls  int64
+	errors int64
+
+	mu    sync.Mutex
+	times []time.Duration // ring buffer, most recent latencyWindow calls
+	next  int
+}
+
+// latencyWindow bounds how many recent call latencies a methodStat keeps
+// for its percentile estimate.
+const latencyWindow = 256
+
+func (ms *methodStat) record(d time.Duration, err error) {
+	atomic.AddInt64(&ms.calls, 1)
+	if err != nil {
+		atomic.AddInt64(&ms.errors, 1)
+	}
+	ms.mu.Lock()
+	if ms.times == nil {
+		ms.times = make([]time.Duration, 0, latencyWindow)
+	}
+	if len(ms.times) < latencyWindow {
+		ms.times = append(ms.times, d)
+	} else {
+		ms.times[ms.next] = d
+		ms.next = (ms.next + 1) % latencyWindow
+	}
+	ms.mu.Unlock()
+}
+
+// percentiles returns the p50 and p99 latency over the retained window.
+func (ms *methodStat) percentiles() (p50, p99 time.Duration) {
+	ms.mu.Lock()
+	times := make([]time.Duration, len(ms.times))
+	copy(times, ms.times)
+	ms.mu.Unlock()
+	if len(times) == 0 {
+		return 0, 0
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+	p50 = times[(len(times)-1)*50/100]
+	p99 = times[(len(times)-1)*99/100]
+	return
+}
+
+// stat records one completed call's latency/outcome for serviceMethod,
+// creating its methodStat on first use.
+func (server *Server) stat(serviceMethod string, d time.Duration, err error) {
+	v, _ := server.stats.LoadOrStore(serviceMethod, &methodStat{})
+	v.(*methodStat).record(d, err)
+}
+
+// streamKey identifies a streaming call within a Server: Seq is only
+// unique per connection, so the codec it arrived on disambiguates calls
+// from different connections that happen to pick the same Seq.
+type streamKey struct {
+	codec ServerCodec
+	seq   uint64
 }
 
 // newServer returns a new Server.
@@ -117,6 +350,8 @@ func isExportedOrBuiltinType(t reflect.Type) bool {
 //	- two arguments, both of exported type
 //	- the second argument is a pointer
 //	- one return value, of type error
+// A method may instead take an rpc.Stream in place of the reply pointer,
+// in which case it is registered as a streaming method (see suitableMethods).
 // It returns an error if the receiver is not an exported type or has
 // no suitable methods. It also logs the error using package log.
 // The client accesses each method using a string of the form "Type.Method",
@@ -218,20 +453,24 @@ func suitableMethods(typ reflect.Type, reportErr bool) map[string]*methodType {
 			}
 			continue
 		}
-		// Thrid arg must be a pointer.
+		// Thrid arg is either a reply pointer (unary) or an rpc.Stream
+		// (streaming); only the former must be a pointer of exported type.
 		replyType := mtype.In(3)
-		if replyType.Kind() != reflect.Ptr {
-			if reportErr {
-				log.Println("method", mname, "reply type not a pointer:", replyType)
+		streaming := replyType.Implements(streamType)
+		if !streaming {
+			if replyType.Kind() != reflect.Ptr {
+				if reportErr {
+					log.Println("method", mname, "reply type not a pointer:", replyType)
+				}
+				continue
 			}
-			continue
-		}
-		// Reply type must be exported.
-		if !isExportedOrBuiltinType(replyType) {
-			if reportErr {
-				log.Println("method", mname, "reply type not exported:", replyType)
+			// Reply type must be exported.
+			if !isExportedOrBuiltinType(replyType) {
+				if reportErr {
+					log.Println("method", mname, "reply type not exported:", replyType)
+				}
+				continue
 			}
-			continue
 		}
 		// Method needs one out.
 		if mtype.NumOut() != 1 {
@@ -247,7 +486,7 @@ func suitableMethods(typ reflect.Type, reportErr bool) map[string]*methodType {
 			}
 			continue
 		}
-		methods[mname] = &methodType{method: method, ArgType: argType, ReplyType: replyType}
+		methods[mname] = &methodType{method: method, ArgType: argType, ReplyType: replyType, Stream: streaming}
 	}
 	return methods
 }
@@ -257,38 +496,38 @@ func suitableMethods(typ reflect.Type, reportErr bool) map[string]*methodType {
 // contains an error when it is used.
 var invalidRequest = struct{}{}
 
-func (server *Server) sendResponse(c context.Context, codec *serverCodec, reply interface{}, errmsg string) {
-	var (
-		err  error
-		ts   Response
-		resp = &codec.resp
-	)
+func (server *Server) sendResponse(c context.Context, sending *sync.Mutex, codec ServerCodec, reply interface{}, errmsg string) {
 	if errmsg != "" {
 		reply = invalidRequest
 	}
-	ts.ServiceMethod = c.ServiceMethod()
-	ts.Seq = c.Seq()
-	ts.Error = errmsg
-	codec.sending.Lock()
-	// NOTE must keep resp goroutine safe
-	*resp = ts
-	// Encode the response header
-	if err = codec.writeResponse(reply); err != nil {
+	resp := &Response{
+		ServiceMethod: c.ServiceMethod(),
+		Seq:           c.Seq(),
+		Error:         errmsg,
+	}
+	sending.Lock()
+	if err := codec.WriteResponse(resp, reply); err != nil {
 		log.Println("rpc: writing response:", err)
 	}
-	codec.sending.Unlock()
+	sending.Unlock()
 }
 
-func (s *service) call(c context.Context, server *Server, mtype *methodType, argv, replyv reflect.Value, codec *serverCodec) {
+func (s *service) call(c context.Context, server *Server, sending *sync.Mutex, mtype *methodType, argv, replyv reflect.Value, codec ServerCodec) {
 	var (
-		err          error
-		errmsg       string
-		errInter     interface{}
-		t            *trace.Trace2
-		ok           bool
-		cv           reflect.Value
-		returnValues []reflect.Value
+		err      error
+		errmsg   string
+		errInter interface{}
+		t        *trace.Trace2
+		ok       bool
 	)
+	key := callKey{codec, c.Seq()}
+	start := time.Now()
+	defer func() {
+		if v, ok := server.inflight.Load(key); ok {
+			v.(ctx.CancelFunc)()
+		}
+		server.inflight.Delete(key)
+	}()
 	if t, ok = trace.FromContext2(c); ok {
 		t.SetFamily(trace.Owner())
 		t.SetClass(class)
@@ -302,17 +541,36 @@ func (s *service) call(c context.Context, server *Server, mtype *methodType, arg
 		}
 	}
 	if err == nil {
+		// deadline is c itself unless a server-side per-method timeout
+		// tightens it further; either way, done fires when the call
+		// should be abandoned, whether the handler notices or not.
+		deadline := ctx.Context(c)
+		if d, ok := server.methodTimeout(c.ServiceMethod()); ok {
+			var cancel ctx.CancelFunc
+			deadline, cancel = ctx.WithTimeout(c, d)
+			defer cancel()
+		}
 		// Invoke the method, providing a new value for the reply.
-		cv = reflect.New(ctxType)
+		cv := reflect.New(ctxType)
 		*cv.Interface().(*context.Context) = c
-		returnValues = mtype.method.Func.Call([]reflect.Value{s.rcvr, cv.Elem(), argv, replyv})
-		// The return value for the method is an error.
-		if errInter = returnValues[0].Interface(); errInter != nil {
-			err = errInter.(error)
+		done := make(chan []reflect.Value, 1)
+		go func() {
+			done <- mtype.method.Func.Call([]reflect.Value{s.rcvr, cv.Elem(), argv, replyv})
+		}()
+		select {
+		case returnValues := <-done:
+			// The return value for the method is an error.
+			if errInter = returnValues[0].Interface(); errInter != nil {
+				err = errInter.(error)
+				errmsg = err.Error()
+			}
+		case <-deadline.Done():
+			err = deadline.Err()
 			errmsg = err.Error()
 		}
 	}
-	server.sendResponse(c, codec, replyv.Interface(), errmsg)
+	server.sendResponse(c, sending, codec, replyv.Interface(), errmsg)
+	server.stat(c.ServiceMethod(), time.Since(start), err)
 	// stat
 	if server.Interceptor != nil {
 		server.Interceptor.Stat(c, argv.Interface(), err)
@@ -322,12 +580,166 @@ func (s *service) call(c context.Context, server *Server, mtype *methodType, arg
 	}
 }
 
-type serverCodec struct {
-	sending sync.Mutex
-	resp    Response
-	req     Request
-	auth    Auth
+// serverStream is the Stream implementation handed to streaming service
+// methods. Send shares the connection's sending mutex with regular unary
+// responses so stream and non-stream frames never interleave on the wire.
+// Recv is handed control of the codec's body read by the connection's
+// read loop (see Server.ServeCodec), which demultiplexes inbound frames
+// by Seq before deciding whether to dispatch to a stream or a new call.
+type serverStream struct {
+	c       context.Context
+	codec   ServerCodec
+	sending *sync.Mutex
+	seq     uint64
+
+	header    chan struct{}
+	bodyDone  chan struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
+}
 
+func newServerStream(c context.Context, codec ServerCodec, sending *sync.Mutex, seq uint64) *serverStream {
+	return &serverStream{
+		c:        c,
+		codec:    codec,
+		sending:  sending,
+		seq:      seq,
+		header:   make(chan struct{}),
+		bodyDone: make(chan struct{}),
+		closed:   make(chan struct{}),
+	}
+}
+
+// dispatch hands a continuation frame's body read to whichever goroutine
+// is blocked in Recv, then waits for it to finish decoding before the
+// read loop moves on to the next frame on the wire. closeRecv may run
+// concurrently with dispatch (the handler returning races the read loop
+// delivering a frame the client pipelined before seeing EOS), so dispatch
+// selects on st.closed rather than sending unconditionally on st.header.
+// A frame that loses that race still arrived on the wire, so its body
+// must be drained here instead of left for ReadRequestHeader to choke on.
+func (st *serverStream) dispatch() {
+	select {
+	case st.header <- struct{}{}:
+		<-st.bodyDone
+	case <-st.closed:
+		st.codec.ReadRequestBody(nil)
+	}
+}
+
+// closeRecv unblocks any pending or future Recv call with io.EOF, used
+// once the client signals inner.EOS or the connection goes away.
+func (st *serverStream) closeRecv() {
+	st.closeOnce.Do(func() { close(st.closed) })
+}
+
+// Send implements Stream.
+func (st *serverStream) Send(v interface{}) error {
+	resp := &Response{ServiceMethod: st.c.ServiceMethod(), Seq: st.seq, Stream: true}
+	st.sending.Lock()
+	err := st.codec.WriteResponse(resp, v)
+	st.sending.Unlock()
+	return err
+}
+
+// Recv implements Stream.
+func (st *serverStream) Recv(v interface{}) error {
+	select {
+	case <-st.header:
+		err := st.codec.ReadRequestBody(v)
+		st.bodyDone <- struct{}{}
+		return err
+	case <-st.closed:
+		return io.EOF
+	}
+}
+
+// Context implements Stream.
+func (st *serverStream) Context() context.Context { return st.c }
+
+func (s *service) callStream(c context.Context, server *Server, sending *sync.Mutex, codec ServerCodec, mtype *methodType, argv reflect.Value) {
+	var (
+		err      error
+		errmsg   string
+		errInter interface{}
+		t        *trace.Trace2
+		ok       bool
+	)
+	key := callKey{codec, c.Seq()}
+	start := time.Now()
+	defer func() {
+		if v, ok := server.inflight.Load(key); ok {
+			v.(ctx.CancelFunc)()
+		}
+		server.inflight.Delete(key)
+	}()
+	if t, ok = trace.FromContext2(c); ok {
+		t.SetFamily(trace.Owner())
+		t.SetClass(class)
+		t.SetTitle(c.ServiceMethod())
+		t.Server("")
+	}
+	if server.Interceptor != nil {
+		if err = server.Interceptor.Rate(c); err != nil {
+			errmsg = err.Error()
+		}
+	}
+	if err == nil {
+		deadline := ctx.Context(c)
+		if d, ok := server.methodTimeout(c.ServiceMethod()); ok {
+			var cancel ctx.CancelFunc
+			deadline, cancel = ctx.WithTimeout(c, d)
+			defer cancel()
+		}
+
+		st := newServerStream(c, codec, sending, c.Seq())
+		server.streams.Store(streamKey{codec, c.Seq()}, st)
+		defer server.streams.Delete(streamKey{codec, c.Seq()})
+		defer st.closeRecv()
+
+		cv := reflect.New(ctxType)
+		*cv.Interface().(*context.Context) = c
+		done := make(chan []reflect.Value, 1)
+		go func() {
+			done <- mtype.method.Func.Call([]reflect.Value{s.rcvr, cv.Elem(), argv, reflect.ValueOf(st)})
+		}()
+		select {
+		case returnValues := <-done:
+			if errInter = returnValues[0].Interface(); errInter != nil {
+				err = errInter.(error)
+				errmsg = err.Error()
+			} else {
+				errmsg = lastStreamResponseError
+			}
+		case <-deadline.Done():
+			err = deadline.Err()
+			errmsg = err.Error()
+		}
+	}
+	// The closing frame is itself a stream frame, so it carries Stream too.
+	sending.Lock()
+	if werr := codec.WriteResponse(&Response{ServiceMethod: c.ServiceMethod(), Seq: c.Seq(), Error: errmsg, Stream: true}, invalidRequest); werr != nil {
+		log.Println("rpc: writing response:", werr)
+	}
+	sending.Unlock()
+	statErr := err
+	if errmsg == lastStreamResponseError {
+		statErr = nil
+	}
+	server.stat(c.ServiceMethod(), time.Since(start), statErr)
+	if server.Interceptor != nil {
+		server.Interceptor.Stat(c, argv.Interface(), err)
+	}
+	if ok {
+		t.Finish()
+	}
+}
+
+// gobServerCodec is the ServerCodec used by ServeConn. It frames Request
+// and Response headers and bodies with encoding/gob, the wire format this
+// package has always spoken. Non-Go or polyglot clients should use one of
+// the codecs under rpc/jsonrpc or rpc/msgpackrpc instead.
+type gobServerCodec struct {
 	rwc    io.ReadWriteCloser
 	dec    *gob.Decoder
 	enc    *gob.Encoder
@@ -336,21 +748,32 @@ type serverCodec struct {
 	closed bool
 }
 
-func (c *serverCodec) readRequestHeader() error {
-	return c.dec.Decode(&c.req)
+func newGobServerCodec(conn net.Conn) *gobServerCodec {
+	buf := bufio.NewWriter(conn)
+	return &gobServerCodec{
+		rwc:    conn,
+		dec:    gob.NewDecoder(conn),
+		enc:    gob.NewEncoder(buf),
+		encBuf: buf,
+		addr:   conn.RemoteAddr(),
+	}
+}
+
+func (c *gobServerCodec) ReadRequestHeader(r *Request) error {
+	return c.dec.Decode(r)
 }
 
-func (c *serverCodec) readRequestBody(body interface{}) error {
+func (c *gobServerCodec) ReadRequestBody(body interface{}) error {
 	return c.dec.Decode(body)
 }
 
-func (c *serverCodec) writeResponse(body interface{}) (err error) {
-	if err = c.enc.Encode(&c.resp); err != nil {
+func (c *gobServerCodec) WriteResponse(r *Response, body interface{}) (err error) {
+	if err = c.enc.Encode(r); err != nil {
 		if c.encBuf.Flush() == nil {
 			// Gob couldn't encode the header. Should not happen, so if it does,
 			// shut down the connection to signal that the connection is broken.
 			log.Println("rpc: gob error encoding response:", err)
-			c.close()
+			c.Close()
 		}
 		return
 	}
@@ -359,14 +782,14 @@ func (c *serverCodec) writeResponse(body interface{}) (err error) {
 			// Was a gob problem encoding the body but the header has been written.
 			// Shut down the connection to signal that the connection is broken.
 			log.Println("rpc: gob error encoding body:", err)
-			c.close()
+			c.Close()
 		}
 		return
 	}
 	return c.encBuf.Flush()
 }
 
-func (c *serverCodec) close() error {
+func (c *gobServerCodec) Close() error {
 	if c.closed {
 		// Only call c.rwc.Close once; otherwise the semantics are undefined.
 		return nil
@@ -375,98 +798,268 @@ func (c *serverCodec) close() error {
 	return c.rwc.Close()
 }
 
+// RemoteAddr implements RemoteAddrCodec.
+func (c *gobServerCodec) RemoteAddr() net.Addr { return c.addr }
+
+// SetReadDeadline implements deadlineCodec.
+func (c *gobServerCodec) SetReadDeadline(t time.Time) error {
+	if conn, ok := c.rwc.(net.Conn); ok {
+		return conn.SetReadDeadline(t)
+	}
+	return nil
+}
+
 // ServeConn runs the server on a single connection.
 // ServeConn blocks, serving the connection until the client hangs up.
 // The caller typically invokes ServeConn in a go statement.
 // ServeConn uses the gob wire format (see package gob) on the
 // connection. To use an alternate codec, use ServeCodec.
 func (server *Server) ServeConn(conn net.Conn) {
-	buf := bufio.NewWriter(conn)
-	srv := &serverCodec{
-		rwc:    conn,
-		dec:    gob.NewDecoder(conn),
-		enc:    gob.NewEncoder(buf),
-		encBuf: buf,
-		addr:   conn.RemoteAddr(),
-	}
-	server.serveCodec(srv)
+	server.ServeCodec(newGobServerCodec(conn))
 }
 
-func (server *Server) handshake(codec *serverCodec) (err error) {
+func (server *Server) handshake(codec ServerCodec) (user string, err error) {
 	var (
-		errmsg string
-		c1     = ctx.Background()
-		req    = &codec.req
+		errmsg  string
+		c1      = ctx.Background()
+		req     Request
+		auth    Auth
+		sending sync.Mutex
 	)
 	if !server.Handshake {
 		return
 	}
-	if err = codec.readRequestHeader(); err != nil {
+	if err = codec.ReadRequestHeader(&req); err != nil {
 		return
 	}
-	if err = codec.readRequestBody(&codec.auth); err != nil {
+	if err = codec.ReadRequestBody(&auth); err != nil {
 		return
 	}
 	if req.ServiceMethod != _authServiceMethod {
-		return errors.New("rpc: auth service method: " + req.ServiceMethod)
+		err = errors.New("rpc: auth service method: " + req.ServiceMethod)
+		return
 	}
+	user = auth.User
 	if server.Interceptor != nil {
+		var addr net.Addr
+		if rac, ok := codec.(RemoteAddrCodec); ok {
+			addr = rac.RemoteAddr()
+		}
 		if req.Trace != nil {
 			c1 = trace.NewContext2(c1, req.Trace)
 		}
-		req.ctx = context.NewContext(c1, codec.auth.User, req.ServiceMethod, req.Seq)
-		if err = server.Interceptor.Auth(req.ctx, codec.addr, codec.auth.Token); err != nil {
+		reqCtx := context.NewContext(c1, user, req.ServiceMethod, req.Seq)
+		if err = server.Interceptor.Auth(reqCtx, addr, auth.Token); err != nil {
 			errmsg = err.Error()
 		}
-		server.sendResponse(req.ctx, codec, invalidRequest, errmsg)
+		server.sendResponse(reqCtx, &sending, codec, invalidRequest, errmsg)
 	}
 	return
 }
 
-// serveCodec is like ServeConn but uses the specified codec to
-// decode requests and encode responses.
-func (server *Server) serveCodec(codec *serverCodec) {
-	req := &codec.req
-	if err := server.handshake(codec); err != nil {
-		codec.close()
-		return
+// ServeCodec is like ServeConn but uses the specified codec to decode
+// requests and encode responses, so callers can speak any wire format
+// that implements ServerCodec (see the jsonrpc and msgpackrpc
+// subpackages) instead of the built-in gob format. The handshake/Auth
+// path, trace propagation and Interceptor hooks behave identically
+// regardless of codec.
+func (server *Server) ServeCodec(codec ServerCodec) {
+	sending := new(sync.Mutex)
+	server.codecs.Store(codec, struct{}{})
+	defer server.codecs.Delete(codec)
+
+	dc, hasDeadline := codec.(deadlineCodec)
+
+	var loopErr error
+	user, err := server.handshake(codec)
+	if err != nil {
+		loopErr = err
 	}
-	for {
-		// serve request
-		service, mtype, argv, replyv, err := server.readRequest(codec)
-		if err != nil {
-			if err != io.EOF {
-				log.Println("rpc:", err)
+	for loopErr == nil {
+		if hasDeadline {
+			if window, ok := server.keepaliveWindow(); ok {
+				dc.SetReadDeadline(time.Now().Add(window))
+			} else {
+				dc.SetReadDeadline(time.Time{})
 			}
-			if req.ctx == nil {
-				break
+		}
+		req := new(Request)
+		if err := codec.ReadRequestHeader(req); err != nil {
+			loopErr = err
+			if err != io.EOF && err != io.ErrUnexpectedEOF {
+				log.Println("rpc: server cannot decode request:", err)
 			}
+			break
+		}
+
+		// A Cancel frame targets an already-dispatched call by Seq; it
+		// never starts a call of its own.
+		if req.Cancel {
+			if v, ok := server.inflight.Load(callKey{codec, req.Seq}); ok {
+				v.(ctx.CancelFunc)()
+			}
+			codec.ReadRequestBody(nil)
+			continue
+		}
+
+		// Continuation frames for an already-open stream bypass the
+		// normal service/method lookup entirely; they're routed by Seq
+		// to the serverStream waiting in Recv.
+		if req.Stream {
+			if v, ok := server.streams.Load(streamKey{codec, req.Seq}); ok {
+				st := v.(*serverStream)
+				if req.ServiceMethod == _eosServiceMethod {
+					codec.ReadRequestBody(nil)
+					st.closeRecv()
+				} else {
+					st.dispatch()
+				}
+				continue
+			}
+		}
+
+		server.mu.Lock()
+		closing := server.closing
+		server.mu.Unlock()
+		if closing {
+			codec.ReadRequestBody(nil)
+			closingCtx := context.NewContext(ctx.Background(), user, req.ServiceMethod, req.Seq)
+			server.sendResponse(closingCtx, sending, codec, invalidRequest, "rpc: server is shutting down")
+			continue
+		}
+
+		service, mtype, err := server.lookupRequest(codec, req, user)
+		if err != nil {
+			log.Println("rpc:", err)
+			codec.ReadRequestBody(nil)
 			errmsg := err.Error()
 			if req.ServiceMethod == _authServiceMethod {
 				errmsg = ""
 			}
-			server.sendResponse(req.ctx, codec, invalidRequest, errmsg)
+			server.sendResponse(req.ctx, sending, codec, invalidRequest, errmsg)
+			continue
+		}
+
+		if mtype.Stream {
+			argv, err := server.readStreamArgs(codec, mtype)
+			if err != nil {
+				log.Println("rpc:", err)
+				server.abandonInflight(codec, req.Seq)
+				server.sendResponse(req.ctx, sending, codec, invalidRequest, err.Error())
+				continue
+			}
+			server.wg.Add(1)
+			go func() {
+				defer server.wg.Done()
+				service.callStream(req.ctx, server, sending, codec, mtype, argv)
+			}()
+			continue
+		}
+
+		argv, replyv, err := server.readRequestArgs(codec, mtype)
+		if err != nil {
+			log.Println("rpc:", err)
+			server.abandonInflight(codec, req.Seq)
+			server.sendResponse(req.ctx, sending, codec, invalidRequest, err.Error())
 			continue
 		}
-		go service.call(req.ctx, server, mtype, argv, replyv, codec)
+		server.wg.Add(1)
+		go func() {
+			defer server.wg.Done()
+			service.call(req.ctx, server, sending, mtype, argv, replyv, codec)
+		}()
+	}
+	codec.Close()
+	server.cancelConn(codec)
+	if server.Interceptor != nil {
+		var addr net.Addr
+		if rac, ok := codec.(RemoteAddrCodec); ok {
+			addr = rac.RemoteAddr()
+		}
+		server.Interceptor.OnDisconnect(ctx.Background(), addr, loopErr)
 	}
-	codec.close()
 }
 
-func (server *Server) readRequest(codec *serverCodec) (service *service, mtype *methodType, argv, replyv reflect.Value, err error) {
-	var req = &codec.req
-	*req = Request{}
-	if service, mtype, err = server.readRequestHeader(codec); err != nil {
-		// keepreading
-		if req.ctx == nil {
-			return
+// Shutdown stops the server gracefully: Accept returns and no longer takes
+// new connections, requests already waiting on existing connections are
+// refused, and in-flight service.call/callStream goroutines are given
+// until ctx's deadline to finish. Whatever connections remain tracked in
+// Server.codecs at that point — finished or not — are then closed.
+func (server *Server) Shutdown(c ctx.Context) error {
+	server.mu.Lock()
+	server.closing = true
+	lis := server.listener
+	server.mu.Unlock()
+	if lis != nil {
+		lis.Close()
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		server.wg.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-c.Done():
+	}
+
+	var err error
+	server.codecs.Range(func(k, _ interface{}) bool {
+		if cerr := k.(ServerCodec).Close(); cerr != nil {
+			err = cerr
+		}
+		return true
+	})
+	return err
+}
+
+// lookupRequest resolves an already-decoded Request header's
+// "Service.Method" into a registered service/method pair and builds the
+// per-call context. The context is cancellable: if req.Deadline is set
+// it bounds the call, otherwise the call can still be cancelled early by
+// a later Request with the same Seq and Cancel set. The cancel func is
+// only kept in server.inflight once the lookup succeeds and a call is
+// actually going to be dispatched; a failed lookup never spawns
+// service.call/callStream, so there would be nothing to ever call or
+// delete it, leaking the map entry.
+func (server *Server) lookupRequest(codec ServerCodec, req *Request, user string) (service *service, mtype *methodType, err error) {
+	dot := strings.LastIndex(req.ServiceMethod, ".")
+	if dot < 0 {
+		err = errors.New("rpc: service/method request ill-formed: " + req.ServiceMethod)
+	} else {
+		serviceName := req.ServiceMethod[:dot]
+		methodName := req.ServiceMethod[dot+1:]
+		if service = server.serviceMap[serviceName]; service == nil {
+			err = errors.New("rpc: can't find service " + req.ServiceMethod)
+		} else if mtype = service.method[methodName]; mtype == nil {
+			err = errors.New("rpc: can't find method " + req.ServiceMethod)
+			service = nil
 		}
-		// discard body
-		codec.readRequestBody(nil)
+	}
+
+	c1 := ctx.Background()
+	if req.Trace != nil {
+		c1 = trace.NewContext2(c1, req.Trace)
+	}
+	if err != nil {
+		req.ctx = context.NewContext(c1, user, req.ServiceMethod, req.Seq)
 		return
 	}
 
-	// Decode the argument value.
+	var cancel ctx.CancelFunc
+	if req.Deadline > 0 {
+		c1, cancel = ctx.WithDeadline(c1, time.Unix(0, req.Deadline))
+	} else {
+		c1, cancel = ctx.WithCancel(c1)
+	}
+	server.inflight.Store(callKey{codec, req.Seq}, cancel)
+	req.ctx = context.NewContext(c1, user, req.ServiceMethod, req.Seq)
+	return
+}
+
+// readRequestArgs decodes a unary call's argument body and allocates its reply.
+func (server *Server) readRequestArgs(codec ServerCodec, mtype *methodType) (argv, replyv reflect.Value, err error) {
 	argIsValue := false // if true, need to indirect before calling.
 	if mtype.ArgType.Kind() == reflect.Ptr {
 		argv = reflect.New(mtype.ArgType.Elem())
@@ -475,55 +1068,32 @@ func (server *Server) readRequest(codec *serverCodec) (service *service, mtype *
 		argIsValue = true
 	}
 	// argv guaranteed to be a pointer now.
-	if err = codec.readRequestBody(argv.Interface()); err != nil {
+	if err = codec.ReadRequestBody(argv.Interface()); err != nil {
 		return
 	}
 	if argIsValue {
 		argv = argv.Elem()
 	}
-
 	replyv = reflect.New(mtype.ReplyType.Elem())
 	return
 }
 
-func (server *Server) readRequestHeader(codec *serverCodec) (service *service, mtype *methodType, err error) {
-	var (
-		c1  = ctx.Background()
-		req = &codec.req
-	)
-	if err = codec.readRequestHeader(); err != nil {
-		if err == io.EOF || err == io.ErrUnexpectedEOF {
-			return
-		}
-		err = errors.New("rpc: server cannot decode request: " + err.Error())
-		return
-	}
-
-	// NOTE ctx not nil then keepreading
-	if req.Trace != nil {
-		c1 = trace.NewContext2(c1, req.Trace)
-	}
-	req.ctx = context.NewContext(c1, codec.auth.User, req.ServiceMethod, req.Seq)
-
-	// We read the header successfully. If we see an error now,
-	// we can still recover and move on to the next request.
-	dot := strings.LastIndex(req.ServiceMethod, ".")
-	if dot < 0 {
-		err = errors.New("rpc: service/method request ill-formed: " + req.ServiceMethod)
-		return
+// readStreamArgs decodes a streaming call's opening argument body. Unlike
+// readRequestArgs it allocates no reply value: mtype.ReplyType is the
+// rpc.Stream interface type, not a reply pointer.
+func (server *Server) readStreamArgs(codec ServerCodec, mtype *methodType) (argv reflect.Value, err error) {
+	argIsValue := false
+	if mtype.ArgType.Kind() == reflect.Ptr {
+		argv = reflect.New(mtype.ArgType.Elem())
+	} else {
+		argv = reflect.New(mtype.ArgType)
+		argIsValue = true
 	}
-	serviceName := req.ServiceMethod[:dot]
-	methodName := req.ServiceMethod[dot+1:]
-
-	// Look up the request.
-	service = server.serviceMap[serviceName]
-	if service == nil {
-		err = errors.New("rpc: can't find service " + req.ServiceMethod)
+	if err = codec.ReadRequestBody(argv.Interface()); err != nil {
 		return
 	}
-	mtype = service.method[methodName]
-	if mtype == nil {
-		err = errors.New("rpc: can't find method " + req.ServiceMethod)
+	if argIsValue {
+		argv = argv.Elem()
 	}
 	return
 }
@@ -533,6 +1103,9 @@ func (server *Server) readRequestHeader(codec *serverCodec) (service *service, m
 // returns a non-nil error. The caller typically invokes Accept in a
 // go statement.
 func (server *Server) Accept(lis net.Listener) {
+	server.mu.Lock()
+	server.listener = lis
+	server.mu.Unlock()
 	for {
 		conn, err := lis.Accept()
 		if err != nil {
@@ -543,6 +1116,47 @@ func (server *Server) Accept(lis net.Listener) {
 	}
 }
 
+// ServeHTTP implements an http.Handler that answers RPC requests by
+// hijacking CONNECT requests and handing the raw connection to ServeConn,
+// the same upgrade stdlib net/rpc uses. Any other method is rejected with
+// 405, matching net/rpc's behavior.
+func (server *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "CONNECT" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		io.WriteString(w, "405 must CONNECT\n")
+		return
+	}
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		log.Print("rpc hijacking ", req.RemoteAddr, ": ", err.Error())
+		return
+	}
+	io.WriteString(conn, "HTTP/1.0 "+_connected+"\n\n")
+	server.ServeConn(conn)
+}
+
+// HandleHTTP registers an HTTP handler for RPC messages on rpcPath, and a
+// debug handler on debugPath, on http.DefaultServeMux. An empty rpcPath or
+// debugPath falls back to _defaultRPCPath ("/_goRPC_") or _defaultDebugPath
+// ("/debug/rpc") respectively. It must be called before http.Serve.
+func (server *Server) HandleHTTP(rpcPath, debugPath string) {
+	if rpcPath == "" {
+		rpcPath = _defaultRPCPath
+	}
+	if debugPath == "" {
+		debugPath = _defaultDebugPath
+	}
+	http.Handle(rpcPath, server)
+	http.Handle(debugPath, debugHTTP{server})
+}
+
+// HandleHTTP registers the DefaultServer's HTTP handlers on the default
+// paths, /_goRPC_ and /debug/rpc, on http.DefaultServeMux.
+func HandleHTTP() {
+	DefaultServer.HandleHTTP("", "")
+}
+
 // Register publishes the receiver's methods in the DefaultServer.
 func Register(rcvr interface{}) error { return DefaultServer.Register(rcvr) }
 
@@ -561,11 +1175,20 @@ func ServeConn(conn net.Conn) {
 	DefaultServer.ServeConn(conn)
 }
 
+// ServeCodec runs the DefaultServer using the specified codec to decode
+// requests and encode responses.
+func ServeCodec(codec ServerCodec) {
+	DefaultServer.ServeCodec(codec)
+}
+
 // Accept accepts connections on the listener and serves requests
 // to DefaultServer for each incoming connection.
 // Accept blocks; the caller typically invokes it in a go statement.
 func Accept(lis net.Listener) { DefaultServer.Accept(lis) }
 
+// Shutdown gracefully shuts down the DefaultServer. See Server.Shutdown.
+func Shutdown(c ctx.Context) error { return DefaultServer.Shutdown(c) }
+
 // pinger rpc ping service
 type pinger struct {
 }
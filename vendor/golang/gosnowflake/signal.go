@@ -17,13 +17,40 @@
 package main
 
 import (
+	"context"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
+
+	"go-common/net/rpc"
 
 	log "golang/log4go"
 )
 
+// shutdownTimeout bounds how long HandleSignal waits for in-flight RPC
+// calls to drain on SIGQUIT/SIGTERM/SIGINT before the process exits.
+const shutdownTimeout = 10 * time.Second
+
+// Reloader re-reads the snowflake/BFS config file from disk and swaps the
+// running worker ID, Interceptor and listener addresses into place.
+// HandleSignal only knows when to invoke Reload on SIGHUP; it has no
+// concrete implementation in this package, because the config file format,
+// worker ID state and listener set it swaps are owned by this binary's
+// entrypoint, not by this file. Whatever constructs the rpc.Server passed to HandleSignal also
+// owns that state and should pass a Reloader closing over it — ReloaderFunc
+// below adapts a plain func to the interface for that common case.
+type Reloader interface {
+	Reload() error
+}
+
+// ReloaderFunc adapts a plain func() error to Reloader, the way
+// http.HandlerFunc adapts a func to http.Handler.
+type ReloaderFunc func() error
+
+// Reload implements Reloader.
+func (f ReloaderFunc) Reload() error { return f() }
+
 // InitSignal register signals handler.
 func InitSignal() chan os.Signal {
 	c := make(chan os.Signal, 1)
@@ -31,20 +58,36 @@ func InitSignal() chan os.Signal {
 	return c
 }
 
-// HandleSignal fetch signal from chan then do exit or reload.
-func HandleSignal(c chan os.Signal) {
+// HandleSignal fetches signals from c and reacts: SIGHUP asks r to reload
+// config without tearing srv down or dropping its connections; every other
+// handled signal gracefully shuts srv down before HandleSignal returns.
+func HandleSignal(c chan os.Signal, srv *rpc.Server, r Reloader) {
 	// Block until a signal is received.
 	for {
 		s := <-c
 		log.Info("gosnowflake get a signal %s", s.String())
 		switch s {
 		case syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGSTOP, syscall.SIGINT:
+			shutdown(srv)
 			return
 		case syscall.SIGHUP:
-			// TODO reload
-			//return
+			if err := r.Reload(); err != nil {
+				log.Error("gosnowflake: reload config error(%v)", err)
+			}
 		default:
+			shutdown(srv)
 			return
 		}
 	}
 }
+
+func shutdown(srv *rpc.Server) {
+	if srv == nil {
+		return
+	}
+	c, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(c); err != nil {
+		log.Error("gosnowflake: shutdown error(%v)", err)
+	}
+}